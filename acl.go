@@ -0,0 +1,342 @@
+// Grumble - an implementation of Murmur in Go
+// Copyright (c) 2010 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"goprotobuf.googlecode.com/hg/proto"
+	"mumbleproto"
+	"sync"
+)
+
+// Permission is a bitset of the permissions that can be granted
+// on a channel, modeled after Murmur's permission system.
+type Permission uint32
+
+const (
+	PermissionWrite           Permission = 0x1
+	PermissionTraverse        Permission = 0x2
+	PermissionEnter           Permission = 0x4
+	PermissionSpeak           Permission = 0x8
+	PermissionMuteDeafen      Permission = 0x10
+	PermissionMove            Permission = 0x20
+	PermissionMakeChannel     Permission = 0x40
+	PermissionLinkChannel     Permission = 0x80
+	PermissionWhisper         Permission = 0x100
+	PermissionTextMessage     Permission = 0x200
+	PermissionMakeTempChannel Permission = 0x400
+
+	// Root channel only
+	PermissionKick         Permission = 0x10000
+	PermissionBan          Permission = 0x20000
+	PermissionRegister     Permission = 0x40000
+	PermissionSelfRegister Permission = 0x80000
+
+	AllPermissions Permission = 0xf07ff
+)
+
+// ChanACL is a single ACL entry attached to a channel. It either applies
+// to a single registered user (UserId >= 0) or to a group (Group != "").
+type ChanACL struct {
+	ApplyHere bool
+	ApplySubs bool
+	Inherited bool
+
+	UserId int
+	Group  string
+
+	Allow Permission
+	Deny  Permission
+}
+
+// Group is a named group of users that can be referenced from a ChanACL.
+// Groups can inherit membership from the same-named group on a parent
+// channel, and can be marked Inheritable to allow sub-channels to see
+// this group's membership.
+type Group struct {
+	Name        string
+	Inherit     bool
+	Inheritable bool
+
+	// Explicit adds/removes relative to the inherited membership.
+	Add    map[int]bool
+	Remove map[int]bool
+}
+
+// NewGroup creates a new, empty Group with the given name.
+func NewGroup(name string) *Group {
+	return &Group{
+		Name:        name,
+		Inherit:     true,
+		Inheritable: true,
+		Add:         make(map[int]bool),
+		Remove:      make(map[int]bool),
+	}
+}
+
+// NewChanACL creates a new, empty ChanACL that applies here and to
+// sub-channels and names no user.
+func NewChanACL() *ChanACL {
+	return &ChanACL{
+		ApplyHere: true,
+		ApplySubs: true,
+		UserId:    -1,
+	}
+}
+
+// permKey identifies a cached permission lookup for a (user, channel) pair.
+type permKey struct {
+	channelId int
+	userId    int
+}
+
+// aclCache caches resolved effective permissions, keyed by channel and
+// user. It is invalidated wholesale whenever any ACL or group in the
+// channel tree changes, since a change anywhere above a channel can
+// affect every descendant's effective permissions.
+var aclCache = struct {
+	sync.Mutex
+	m map[permKey]Permission
+}{m: make(map[permKey]Permission)}
+
+// flushACLCache discards all cached permission lookups. It must be called
+// whenever an ACL or Group is added, removed or edited.
+func flushACLCache() {
+	aclCache.Lock()
+	aclCache.m = make(map[permKey]Permission)
+	aclCache.Unlock()
+}
+
+// groupMembers returns the effective membership of the group named name
+// on channel, walking up the channel tree to honor Inherit/Inheritable
+// and applying this channel's own Add/Remove overrides last.
+func groupMembers(channel *Channel, name string) map[int]bool {
+	members := make(map[int]bool)
+
+	group := channel.Groups[name]
+	if group != nil && group.Inherit && channel.Parent != nil {
+		parentGroup := channel.Parent.Groups[name]
+		if parentGroup == nil || parentGroup.Inheritable {
+			for uid := range groupMembers(channel.Parent, name) {
+				members[uid] = true
+			}
+		}
+	} else if group == nil && channel.Parent != nil {
+		// No group defined here; fall back to an inheritable parent
+		// group so descendants still see its membership.
+		parentGroup := channel.Parent.Groups[name]
+		if parentGroup != nil && parentGroup.Inheritable {
+			for uid := range groupMembers(channel.Parent, name) {
+				members[uid] = true
+			}
+		}
+	}
+
+	if group != nil {
+		for uid := range group.Add {
+			members[uid] = true
+		}
+		for uid := range group.Remove {
+			members[uid] = false, false
+		}
+	}
+
+	return members
+}
+
+// inGroup reports whether client is a member of the named group as seen
+// from channel. The special groups "all", "auth" and "in" are handled
+// without requiring an explicit Group definition.
+func inGroup(channel *Channel, client *Client, name string) bool {
+	switch name {
+	case "all":
+		return true
+	case "auth":
+		return client.UserId >= 0
+	case "in":
+		return true
+	}
+	return groupMembers(channel, name)[client.UserId]
+}
+
+// effectivePermissions walks the channel tree from root to channel,
+// applying every applicable ACL entry in order, and returns the
+// resulting permission bitset for client.
+func effectivePermissions(channel *Channel, client *Client) Permission {
+	var chain []*Channel
+	for c := channel; c != nil; c = c.Parent {
+		chain = append([]*Channel{c}, chain...)
+	}
+
+	var perm Permission
+	for i, c := range chain {
+		isLeaf := i == len(chain)-1
+		for _, acl := range c.ACLs {
+			if !isLeaf && !acl.ApplySubs {
+				continue
+			}
+			if isLeaf && !acl.ApplyHere {
+				continue
+			}
+
+			var applies bool
+			if acl.UserId >= 0 {
+				applies = acl.UserId == client.UserId
+			} else if acl.Group != "" {
+				applies = inGroup(c, client, acl.Group)
+			}
+			if !applies {
+				continue
+			}
+
+			perm &^= acl.Deny
+			perm |= acl.Allow
+		}
+	}
+	return perm
+}
+
+// HasPermission reports whether client holds perm on channel, either
+// directly or via the SuperUser override (UserId 0). Results are cached
+// per (channel, user) pair until the cache is flushed by an ACL/group
+// edit.
+func HasPermission(channel *Channel, client *Client, perm Permission) bool {
+	if client.UserId == 0 {
+		return true
+	}
+
+	key := permKey{channelId: channel.Id, userId: client.UserId}
+
+	aclCache.Lock()
+	cached, ok := aclCache.m[key]
+	aclCache.Unlock()
+
+	if !ok {
+		cached = effectivePermissions(channel, client)
+		aclCache.Lock()
+		aclCache.m[key] = cached
+		aclCache.Unlock()
+	}
+
+	return cached&perm == perm
+}
+
+// MessageACL marshals channel's ACL and Group configuration as a
+// mumbleproto.ACL message, suitable as a response to an ACL query.
+func (server *Server) MessageACL(channel *Channel) *mumbleproto.ACL {
+	acl := &mumbleproto.ACL{
+		ChannelId:   proto.Uint32(uint32(channel.Id)),
+		InheritAcls: proto.Bool(true),
+	}
+
+	for _, entry := range channel.ACLs {
+		chanacl := &mumbleproto.ACL_ChanACL{
+			ApplyHere: proto.Bool(entry.ApplyHere),
+			ApplySubs: proto.Bool(entry.ApplySubs),
+			Inherited: proto.Bool(entry.Inherited),
+			Grant:     proto.Uint32(uint32(entry.Allow)),
+			Deny:      proto.Uint32(uint32(entry.Deny)),
+		}
+		if entry.UserId >= 0 {
+			chanacl.UserId = proto.Uint32(uint32(entry.UserId))
+		} else {
+			chanacl.Group = proto.String(entry.Group)
+		}
+		acl.Acls = append(acl.Acls, chanacl)
+	}
+
+	for name, group := range channel.Groups {
+		grp := &mumbleproto.ACL_ChanGroup{
+			Name:        proto.String(name),
+			Inherit:     proto.Bool(group.Inherit),
+			Inheritable: proto.Bool(group.Inheritable),
+		}
+		for uid := range group.Add {
+			grp.Add = append(grp.Add, uint32(uid))
+		}
+		for uid := range group.Remove {
+			grp.Remove = append(grp.Remove, uint32(uid))
+		}
+		for uid := range groupMembers(channel, name) {
+			grp.InheritedMembers = append(grp.InheritedMembers, uint32(uid))
+		}
+		acl.Groups = append(acl.Groups, grp)
+	}
+
+	return acl
+}
+
+// sendPermissionDenied notifies client that it (or, when acting on
+// someone else's behalf, the user it tried to act on) lacks perm on
+// channel.
+func (client *Client) sendPermissionDenied(user *Client, channel *Channel, perm Permission) {
+	client.sendProtoMessage(MessagePermissionDenied, &mumbleproto.PermissionDenied{
+		Permission: proto.Uint32(uint32(perm)),
+		ChannelId:  proto.Uint32(uint32(channel.Id)),
+		Session:    proto.Uint32(user.Session),
+		Reason:     proto.String("Permission denied"),
+	})
+}
+
+// ApplyACL replaces channel's ACL and Group configuration with the
+// entries described by acl, and flushes the permission cache.
+func (server *Server) ApplyACL(channel *Channel, acl *mumbleproto.ACL) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	channel.ACLs = nil
+	for _, chanacl := range acl.Acls {
+		entry := NewChanACL()
+		entry.ApplyHere = chanacl.GetApplyHere()
+		entry.ApplySubs = chanacl.GetApplySubs()
+		entry.Allow = Permission(chanacl.GetGrant())
+		entry.Deny = Permission(chanacl.GetDeny())
+		if chanacl.Group != nil {
+			entry.Group = chanacl.GetGroup()
+		} else {
+			entry.UserId = int(chanacl.GetUserId())
+		}
+		channel.ACLs = append(channel.ACLs, entry)
+	}
+
+	channel.Groups = make(map[string]*Group)
+	for _, grp := range acl.Groups {
+		group := NewGroup(grp.GetName())
+		group.Inherit = grp.GetInherit()
+		group.Inheritable = grp.GetInheritable()
+		for _, uid := range grp.Add {
+			group.Add[int(uid)] = true
+		}
+		for _, uid := range grp.Remove {
+			group.Remove[int(uid)] = true
+		}
+		channel.Groups[group.Name] = group
+	}
+
+	flushACLCache()
+
+	if server.freeze != nil {
+		server.freeze.UpdateFrozenACLs(channel.Id, frozenACLsOf(channel))
+	}
+}
+
+// frozenACLsOf projects channel's in-memory ACL list into its on-disk
+// representation, for callers that need to log or snapshot it as a
+// whole (ApplyACL, Server.frozenSnapshot).
+func frozenACLsOf(channel *Channel) []*FrozenACL {
+	entries := []*FrozenACL{}
+	for _, entry := range channel.ACLs {
+		entries = append(entries, &FrozenACL{
+			ChannelId: channel.Id,
+			ApplyHere: entry.ApplyHere,
+			ApplySubs: entry.ApplySubs,
+			UserId:    entry.UserId,
+			Group:     entry.Group,
+			Allow:     entry.Allow,
+			Deny:      entry.Deny,
+		})
+	}
+	return entries
+}
@@ -0,0 +1,102 @@
+// Grumble - an implementation of Murmur in Go
+// Copyright (c) 2010 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"testing"
+)
+
+func newTestChannel(id int, parent *Channel) *Channel {
+	return &Channel{
+		Id:     id,
+		Parent: parent,
+		Users:  make(map[uint32]*Client),
+		Groups: make(map[string]*Group),
+	}
+}
+
+func TestGroupMembersInheritsFromParent(t *testing.T) {
+	root := newTestChannel(0, nil)
+	root.Groups["staff"] = &Group{
+		Name:        "staff",
+		Inherit:     true,
+		Inheritable: true,
+		Add:         map[int]bool{1: true},
+		Remove:      make(map[int]bool),
+	}
+
+	sub := newTestChannel(1, root)
+
+	members := groupMembers(sub, "staff")
+	if !members[1] {
+		t.Errorf("expected user 1 to inherit staff membership from the parent channel's group")
+	}
+}
+
+func TestGroupMembersAppliesLocalRemoveOverInherited(t *testing.T) {
+	root := newTestChannel(0, nil)
+	root.Groups["staff"] = &Group{
+		Name:        "staff",
+		Inherit:     true,
+		Inheritable: true,
+		Add:         map[int]bool{1: true, 2: true},
+		Remove:      make(map[int]bool),
+	}
+
+	sub := newTestChannel(1, root)
+	sub.Groups["staff"] = &Group{
+		Name:    "staff",
+		Inherit: true,
+		Add:     make(map[int]bool),
+		Remove:  map[int]bool{2: true},
+	}
+
+	members := groupMembers(sub, "staff")
+	if !members[1] {
+		t.Errorf("expected user 1 to still be a member via inheritance")
+	}
+	if members[2] {
+		t.Errorf("expected user 2 to be removed by the sub-channel's local override")
+	}
+}
+
+func TestEffectivePermissionsHonorsApplyHereAndApplySubs(t *testing.T) {
+	root := newTestChannel(0, nil)
+	sub := newTestChannel(1, root)
+
+	// Grants Write to everyone, but only directly on root - not on
+	// descendants - since ApplySubs is false.
+	root.ACLs = []*ChanACL{
+		{ApplyHere: true, ApplySubs: false, UserId: -1, Group: "all", Allow: PermissionWrite},
+	}
+
+	actor := &Client{UserId: 7}
+
+	if !HasPermission(root, actor, PermissionWrite) {
+		t.Errorf("expected Write to be granted directly on root")
+	}
+	if HasPermission(sub, actor, PermissionWrite) {
+		t.Errorf("expected Write to not propagate to sub since the grant's ApplySubs is false")
+	}
+}
+
+func TestEffectivePermissionsSubChannelDenyOverridesInheritedAllow(t *testing.T) {
+	root := newTestChannel(0, nil)
+	sub := newTestChannel(1, root)
+
+	root.ACLs = []*ChanACL{
+		{ApplyHere: true, ApplySubs: true, UserId: -1, Group: "all", Allow: PermissionWrite},
+	}
+	sub.ACLs = []*ChanACL{
+		{ApplyHere: true, ApplySubs: true, UserId: -1, Group: "all", Deny: PermissionWrite},
+	}
+
+	actor := &Client{UserId: 42}
+
+	if HasPermission(sub, actor, PermissionWrite) {
+		t.Errorf("expected sub's explicit Deny to override the inherited Allow from root")
+	}
+}
@@ -0,0 +1,14 @@
+// Grumble - an implementation of Murmur in Go
+// Copyright (c) 2010 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// Ban is a single entry in the server's ban list. A connecting client
+// matching Address (masked by Mask) is rejected before authentication.
+type Ban struct {
+	Address string
+	Mask    int
+	Reason  string
+}
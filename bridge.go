@@ -0,0 +1,273 @@
+// Grumble - an implementation of Murmur in Go
+// Copyright (c) 2010 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"goprotobuf.googlecode.com/hg/proto"
+	"http"
+	"json"
+	"log"
+	"mumbleproto"
+	"net"
+	"os"
+	"sync"
+)
+
+// BridgeEvent is a single state change delivered to subscribers of the
+// bridge's event stream. Kind is one of "UserState", "ChannelState" or
+// "TextMessage", mirroring the TCP message kinds the same data travels
+// as on the native protocol.
+type BridgeEvent struct {
+	Kind    string      `json:"kind"`
+	Payload interface{} `json:"payload"`
+}
+
+// BridgeChannel is the JSON projection of a Channel used by the bridge API.
+type BridgeChannel struct {
+	Id       int    `json:"id"`
+	Name     string `json:"name"`
+	ParentId int    `json:"parent_id"`
+}
+
+// BridgeUser is the JSON projection of a Client used by the bridge API.
+type BridgeUser struct {
+	Session   uint32 `json:"session"`
+	Name      string `json:"name"`
+	ChannelId int    `json:"channel_id"`
+}
+
+// BridgeServer exposes a small HTTP+JSON control surface that lets
+// external bots and bridges (e.g. a Matterbridge-style relay) inject
+// and observe chat and presence without speaking the native Mumble
+// wire protocol.
+type BridgeServer struct {
+	server *Server
+	token  string
+	// actor is the synthetic client used as Actor for messages the
+	// bridge posts on behalf of an external bot, so they flow through
+	// deliverTextMessage exactly like a native client's message would.
+	actor *Client
+
+	mu          sync.Mutex
+	subscribers map[chan BridgeEvent]bool
+}
+
+// NewBridgeServer creates a bridge for server, authenticating requests
+// against the given shared token.
+func NewBridgeServer(server *Server, token string) *BridgeServer {
+	return &BridgeServer{
+		server: server,
+		token:  token,
+		// UserId -1 marks actor as an unregistered guest, not UserId 0
+		// (the SuperUser sentinel HasPermission special-cases). The
+		// bridge should be checked against each channel's TextMessage
+		// ACL like any other poster, not bypass it.
+		actor:       &Client{Session: 0, Username: "bridge", UserId: -1},
+		subscribers: make(map[chan BridgeEvent]bool),
+	}
+}
+
+// Publish fans out ev to every connected Events stream. It is called by
+// the message handlers whenever they apply a UserState, ChannelState or
+// TextMessage change, so bridge subscribers see the same events a
+// native client would.
+func (bs *BridgeServer) Publish(ev BridgeEvent) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	for ch := range bs.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			// Slow subscriber; drop the event rather than block
+			// the handler that produced it.
+		}
+	}
+}
+
+func (bs *BridgeServer) authorized(req *http.Request) bool {
+	return req.Header.Get("Authorization") == "Bearer "+bs.token
+}
+
+// ListenAndServe starts the bridge's HTTP listener on addr.
+func (bs *BridgeServer) ListenAndServe(addr string) os.Error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/send", bs.handleSend)
+	mux.HandleFunc("/v1/move", bs.handleMove)
+	mux.HandleFunc("/v1/channels", bs.handleListChannels)
+	mux.HandleFunc("/v1/users", bs.handleListUsers)
+	mux.HandleFunc("/v1/events", bs.handleEvents)
+
+	log.Printf("BridgeServer listening on %v", addr)
+	return http.Serve(listener, mux)
+}
+
+func (bs *BridgeServer) handleSend(w http.ResponseWriter, req *http.Request) {
+	if !bs.authorized(req) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var body struct {
+		ChannelId int    "json:\"channel_id\""
+		Message   string "json:\"message\""
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	stateMu.Lock()
+	channel := bs.server.channels[body.ChannelId]
+	stateMu.Unlock()
+	if channel == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// Route through the exact same path a native client's
+	// handleTextMessage uses, so a bridge message is indistinguishable
+	// from one posted by a real client.
+	bs.server.deliverTextMessage(bs.actor, &mumbleproto.TextMessage{
+		ChannelId: []uint32{uint32(body.ChannelId)},
+		Message:   proto.String(body.Message),
+	})
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (bs *BridgeServer) handleMove(w http.ResponseWriter, req *http.Request) {
+	if !bs.authorized(req) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var body struct {
+		Session   uint32 "json:\"session\""
+		ChannelId int    "json:\"channel_id\""
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	stateMu.Lock()
+	user, ok := bs.server.clients[body.Session]
+	if !ok {
+		stateMu.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	channel := bs.server.channels[body.ChannelId]
+	if channel == nil {
+		stateMu.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	bs.server.moveUserToChannelLocked(user, channel)
+	stateMu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+// moveUserToChannel updates user's channel membership and notifies
+// every connected client, mirroring the move performed by
+// handleUserStateMessage when a 'move' ACL check passes.
+func (server *Server) moveUserToChannel(user *Client, channel *Channel) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	server.moveUserToChannelLocked(user, channel)
+}
+
+// moveUserToChannelLocked is moveUserToChannel's body, split out so
+// callers that already hold stateMu (e.g. RemoveChannel moving out
+// every occupant of a deleted channel) don't deadlock re-acquiring it.
+func (server *Server) moveUserToChannelLocked(user *Client, channel *Channel) {
+	if user.Channel != nil {
+		user.Channel.Users[user.Session] = nil, false
+	}
+	user.Channel = channel
+	channel.Users[user.Session] = user
+
+	for _, client := range server.clients {
+		client.sendProtoMessage(MessageUserState, &mumbleproto.UserState{
+			Session:   proto.Uint32(user.Session),
+			ChannelId: proto.Uint32(uint32(channel.Id)),
+		})
+	}
+}
+
+func (bs *BridgeServer) handleListChannels(w http.ResponseWriter, req *http.Request) {
+	if !bs.authorized(req) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	stateMu.Lock()
+	channels := []BridgeChannel{}
+	for id, channel := range bs.server.channels {
+		parentId := -1
+		if channel.Parent != nil {
+			parentId = channel.Parent.Id
+		}
+		channels = append(channels, BridgeChannel{Id: id, Name: channel.Name, ParentId: parentId})
+	}
+	stateMu.Unlock()
+	json.NewEncoder(w).Encode(channels)
+}
+
+func (bs *BridgeServer) handleListUsers(w http.ResponseWriter, req *http.Request) {
+	if !bs.authorized(req) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	stateMu.Lock()
+	users := []BridgeUser{}
+	for session, client := range bs.server.clients {
+		channelId := -1
+		if client.Channel != nil {
+			channelId = client.Channel.Id
+		}
+		users = append(users, BridgeUser{Session: session, Name: client.Username, ChannelId: channelId})
+	}
+	stateMu.Unlock()
+	json.NewEncoder(w).Encode(users)
+}
+
+// handleEvents streams newline-delimited JSON BridgeEvents for as long
+// as the connection stays open.
+func (bs *BridgeServer) handleEvents(w http.ResponseWriter, req *http.Request) {
+	if !bs.authorized(req) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	ch := make(chan BridgeEvent, 64)
+	bs.mu.Lock()
+	bs.subscribers[ch] = true
+	bs.mu.Unlock()
+	defer func() {
+		bs.mu.Lock()
+		bs.subscribers[ch] = false, false
+		bs.mu.Unlock()
+		close(ch)
+	}()
+
+	encoder := json.NewEncoder(w)
+	for ev := range ch {
+		if err := encoder.Encode(ev); err != nil {
+			return
+		}
+		if flusher, ok := w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+}
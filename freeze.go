@@ -0,0 +1,281 @@
+// Grumble - an implementation of Murmur in Go
+// Copyright (c) 2010 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"gob"
+	"log"
+	"os"
+	"sync"
+)
+
+// FrozenUser is the on-disk representation of a registered user.
+type FrozenUser struct {
+	Id       int
+	Name     string
+	CertHash string
+	Comment  string
+}
+
+// FrozenChannel is the on-disk representation of a channel.
+type FrozenChannel struct {
+	Id       int
+	Name     string
+	ParentId int
+}
+
+// FrozenBan is the on-disk representation of a ban list entry.
+type FrozenBan struct {
+	Address string
+	Mask    int
+	Reason  string
+}
+
+// FrozenACL is the on-disk representation of a single channel ACL
+// entry. Channel groups are not frozen: neither FrozenChannel nor any
+// other record carries group data, so groups are not restored by Load.
+type FrozenACL struct {
+	ChannelId int
+	ApplyHere bool
+	ApplySubs bool
+	UserId    int
+	Group     string
+	Allow     Permission
+	Deny      Permission
+}
+
+// FrozenACLReplace is the whole ACL list for a single channel as of
+// some point in the log. ApplyACL always replaces a channel's ACLs
+// wholesale, so the log has to record the same thing, or a revoked
+// entry would never stop being replayed.
+type FrozenACLReplace struct {
+	ChannelId int
+	Entries   []*FrozenACL
+}
+
+// frozenRecord is a single entry in the append-only delta log. Exactly
+// one of the payload fields is set; Deleted distinguishes an upsert
+// from a removal of the keyed record. Bans and a channel's ACLs have
+// no stable per-entry key, so BansReplace/ACLsReplace each carry the
+// entire list as of that point in the log rather than a per-entry
+// upsert, the same way Compact always writes the full lists into a
+// snapshot.
+type frozenRecord struct {
+	Seq     int64
+	Deleted bool
+
+	User        *FrozenUser
+	Channel     *FrozenChannel
+	ACLsReplace *FrozenACLReplace
+	BansReplace []*FrozenBan
+}
+
+// frozenSnapshot is the full-state file written by Compact: every
+// record needed to reconstruct the server without replaying history.
+type frozenSnapshot struct {
+	Seq      int64
+	Users    []*FrozenUser
+	Channels []*FrozenChannel
+	Bans     []*FrozenBan
+	ACLs     []*FrozenACL
+}
+
+// FreezeLog snapshots and incrementally logs mutations to users,
+// channels, bans and ACLs so they survive a server restart. We use
+// gob rather than the wire protobuf format for these records: unlike
+// the Mumble client protocol, nothing outside grumble itself ever
+// needs to read this file, so there is no benefit to hand-maintaining
+// a .proto schema for it.
+type FreezeLog struct {
+	mu sync.Mutex
+
+	snapshotPath string
+	logPath      string
+	logFile      *os.File
+	encoder      *gob.Encoder
+	seq          int64
+}
+
+// NewFreezeLog opens (creating if necessary) the snapshot and delta
+// log files under dir.
+func NewFreezeLog(dir string) (*FreezeLog, os.Error) {
+	fl := &FreezeLog{
+		snapshotPath: dir + "/snapshot.gob",
+		logPath:      dir + "/delta.log",
+	}
+
+	logFile, err := os.OpenFile(fl.logPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	fl.logFile = logFile
+	fl.encoder = gob.NewEncoder(logFile)
+
+	return fl, nil
+}
+
+func (fl *FreezeLog) append(record frozenRecord) {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	fl.seq++
+	record.Seq = fl.seq
+	if err := fl.encoder.Encode(&record); err != nil {
+		log.Printf("freeze: failed to append record: %v", err)
+	}
+}
+
+// UpdateFrozenUser appends an upsert record for user to the delta log.
+// It is called from handleUserStateMessage whenever it applies a
+// comment, texture, registration, channel move or mute/deafen change.
+func (fl *FreezeLog) UpdateFrozenUser(user *FrozenUser) {
+	fl.append(frozenRecord{User: user})
+}
+
+// UpdateFrozenChannel appends an upsert record for channel.
+func (fl *FreezeLog) UpdateFrozenChannel(channel *FrozenChannel) {
+	fl.append(frozenRecord{Channel: channel})
+}
+
+// RemoveFrozenChannel appends a deletion record for the channel with id.
+func (fl *FreezeLog) RemoveFrozenChannel(id int) {
+	fl.append(frozenRecord{Deleted: true, Channel: &FrozenChannel{Id: id}})
+}
+
+// UpdateFrozenBans replaces the server's ban list wholesale; callers
+// pass the full list after every edit, whether it came from
+// MessageBanList, a ban via UserRemove or the management API. A single record
+// carries the whole list so a later removal is represented, rather than
+// lost among per-ban upserts that are never retracted.
+func (fl *FreezeLog) UpdateFrozenBans(bans []*FrozenBan) {
+	fl.append(frozenRecord{BansReplace: bans})
+}
+
+// UpdateFrozenACLs replaces channelId's entire ACL list, since ApplyACL
+// always edits a channel's ACLs as a full list via MessageACL. A single
+// record carries the whole list so a later revocation is represented,
+// rather than lost among per-entry upserts that are never retracted.
+func (fl *FreezeLog) UpdateFrozenACLs(channelId int, entries []*FrozenACL) {
+	fl.append(frozenRecord{ACLsReplace: &FrozenACLReplace{ChannelId: channelId, Entries: entries}})
+}
+
+// replayInto applies a single record onto snap, used both when reading
+// the delta log at startup and when compacting it into a fresh
+// snapshot.
+func replayInto(snap *frozenSnapshot, record *frozenRecord) {
+	snap.Seq = record.Seq
+
+	switch {
+	case record.User != nil:
+		for i, u := range snap.Users {
+			if u.Id == record.User.Id {
+				snap.Users[i] = record.User
+				return
+			}
+		}
+		snap.Users = append(snap.Users, record.User)
+
+	case record.Channel != nil && record.Deleted:
+		channels := []*FrozenChannel{}
+		for _, c := range snap.Channels {
+			if c.Id != record.Channel.Id {
+				channels = append(channels, c)
+			}
+		}
+		snap.Channels = channels
+
+	case record.Channel != nil:
+		for i, c := range snap.Channels {
+			if c.Id == record.Channel.Id {
+				snap.Channels[i] = record.Channel
+				return
+			}
+		}
+		snap.Channels = append(snap.Channels, record.Channel)
+
+	case record.BansReplace != nil:
+		snap.Bans = record.BansReplace
+
+	case record.ACLsReplace != nil:
+		acls := []*FrozenACL{}
+		for _, a := range snap.ACLs {
+			if a.ChannelId != record.ACLsReplace.ChannelId {
+				acls = append(acls, a)
+			}
+		}
+		snap.ACLs = append(acls, record.ACLsReplace.Entries...)
+	}
+}
+
+// Load reconstructs server.channels (with their ACLs), server.bans and
+// server.frozenUsers by replaying the last snapshot followed by every
+// delta logged since it was taken. server.clients is not touched.
+func (fl *FreezeLog) Load(server *Server) os.Error {
+	snap := &frozenSnapshot{}
+
+	if snapshotFile, err := os.Open(fl.snapshotPath); err == nil {
+		decoder := gob.NewDecoder(snapshotFile)
+		decoder.Decode(snap)
+		snapshotFile.Close()
+	}
+
+	logFile, err := os.Open(fl.logPath)
+	if err != nil {
+		return err
+	}
+	defer logFile.Close()
+
+	decoder := gob.NewDecoder(logFile)
+	for {
+		record := &frozenRecord{}
+		if err := decoder.Decode(record); err != nil {
+			break
+		}
+		replayInto(snap, record)
+	}
+
+	fl.seq = snap.Seq
+	server.applyFrozenSnapshot(snap)
+	return nil
+}
+
+// Compact fuses the current delta log back into a new snapshot file
+// and truncates the log, so startup no longer has to replay history
+// that predates the snapshot. It should be called periodically, e.g.
+// from a time.Tick loop in the server's accept goroutine.
+func (fl *FreezeLog) Compact(server *Server) os.Error {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	snap := server.frozenSnapshot()
+	snap.Seq = fl.seq
+
+	tmpPath := fl.snapshotPath + ".tmp"
+	tmpFile, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(tmpFile).Encode(snap); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	tmpFile.Close()
+
+	if err := os.Rename(tmpPath, fl.snapshotPath); err != nil {
+		return err
+	}
+
+	fl.logFile.Close()
+	logFile, err := os.OpenFile(fl.logPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	fl.logFile = logFile
+	fl.encoder = gob.NewEncoder(logFile)
+
+	log.Printf("freeze: compacted log into snapshot at seq %v", snap.Seq)
+	return nil
+}
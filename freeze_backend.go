@@ -0,0 +1,93 @@
+// Grumble - an implementation of Murmur in Go
+// Copyright (c) 2010 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// applyFrozenSnapshot reconstructs server.channels from snap, and
+// records each frozen user's comment and each channel's ACLs so they
+// are in place before any client connects. It is called once, from
+// FreezeLog.Load at startup.
+func (server *Server) applyFrozenSnapshot(snap *frozenSnapshot) {
+	byId := make(map[int]*Channel)
+	for _, fc := range snap.Channels {
+		channel := &Channel{
+			Id:     fc.Id,
+			Name:   fc.Name,
+			Users:  make(map[uint32]*Client),
+			Groups: make(map[string]*Group),
+		}
+		byId[fc.Id] = channel
+		server.channels[fc.Id] = channel
+	}
+	for _, fc := range snap.Channels {
+		channel := byId[fc.Id]
+		if parent, ok := byId[fc.ParentId]; ok && parent != channel {
+			channel.Parent = parent
+			parent.Children = append(parent.Children, channel)
+		}
+	}
+
+	for _, facl := range snap.ACLs {
+		channel, ok := byId[facl.ChannelId]
+		if !ok {
+			continue
+		}
+		entry := NewChanACL()
+		entry.ApplyHere = facl.ApplyHere
+		entry.ApplySubs = facl.ApplySubs
+		entry.UserId = facl.UserId
+		entry.Group = facl.Group
+		entry.Allow = facl.Allow
+		entry.Deny = facl.Deny
+		channel.ACLs = append(channel.ACLs, entry)
+	}
+
+	for _, fb := range snap.Bans {
+		server.bans = append(server.bans, &Ban{Address: fb.Address, Mask: fb.Mask, Reason: fb.Reason})
+	}
+
+	server.frozenUsers = make(map[int]*FrozenUser)
+	for _, fu := range snap.Users {
+		server.frozenUsers[fu.Id] = fu
+	}
+
+	flushACLCache()
+}
+
+// frozenSnapshot captures the server's current persisted state for
+// Compact to write out as a fresh snapshot file.
+func (server *Server) frozenSnapshot() *frozenSnapshot {
+	snap := &frozenSnapshot{}
+
+	for id, channel := range server.channels {
+		parentId := 0
+		if channel.Parent != nil {
+			parentId = channel.Parent.Id
+		}
+		snap.Channels = append(snap.Channels, &FrozenChannel{Id: id, Name: channel.Name, ParentId: parentId})
+		snap.ACLs = append(snap.ACLs, frozenACLsOf(channel)...)
+	}
+
+	for _, ban := range server.bans {
+		snap.Bans = append(snap.Bans, &FrozenBan{Address: ban.Address, Mask: ban.Mask, Reason: ban.Reason})
+	}
+
+	for _, fu := range server.frozenUsers {
+		snap.Users = append(snap.Users, fu)
+	}
+
+	return snap
+}
+
+// freezeUser persists user's registration state (comment included) if
+// the server has freezing enabled.
+func (server *Server) freezeUser(user *Client) {
+	if server.freeze == nil {
+		return
+	}
+	fu := &FrozenUser{Id: user.UserId, Name: user.Username, Comment: user.Comment}
+	server.frozenUsers[user.UserId] = fu
+	server.freeze.UpdateFrozenUser(fu)
+}
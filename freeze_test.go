@@ -0,0 +1,109 @@
+// Grumble - an implementation of Murmur in Go
+// Copyright (c) 2010 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestReplayIntoUpsertsUserById(t *testing.T) {
+	snap := &frozenSnapshot{}
+
+	replayInto(snap, &frozenRecord{Seq: 1, User: &FrozenUser{Id: 1, Name: "alice"}})
+	replayInto(snap, &frozenRecord{Seq: 2, User: &FrozenUser{Id: 1, Name: "alice2"}})
+
+	if len(snap.Users) != 1 || snap.Users[0].Name != "alice2" {
+		t.Errorf("expected a single user record updated in place, got %#v", snap.Users)
+	}
+}
+
+func TestReplayIntoDeletesChannelById(t *testing.T) {
+	snap := &frozenSnapshot{}
+
+	replayInto(snap, &frozenRecord{Seq: 1, Channel: &FrozenChannel{Id: 1, Name: "Root"}})
+	replayInto(snap, &frozenRecord{Seq: 2, Channel: &FrozenChannel{Id: 2, Name: "Sub"}})
+	replayInto(snap, &frozenRecord{Seq: 3, Deleted: true, Channel: &FrozenChannel{Id: 1}})
+
+	if len(snap.Channels) != 1 || snap.Channels[0].Id != 2 {
+		t.Errorf("expected only channel 2 to remain, got %#v", snap.Channels)
+	}
+}
+
+func TestReplayIntoBansReplaceDropsRevokedBan(t *testing.T) {
+	snap := &frozenSnapshot{}
+
+	replayInto(snap, &frozenRecord{Seq: 1, BansReplace: []*FrozenBan{{Address: "1.2.3.4"}, {Address: "5.6.7.8"}}})
+	replayInto(snap, &frozenRecord{Seq: 2, BansReplace: []*FrozenBan{{Address: "5.6.7.8"}}})
+
+	if len(snap.Bans) != 1 || snap.Bans[0].Address != "5.6.7.8" {
+		t.Errorf("expected the ban replace to fully supersede the earlier list, got %#v", snap.Bans)
+	}
+}
+
+// TestReplayIntoACLsReplaceDropsRevokedEntry guards against the bug
+// fixed alongside this test: an ACL upsert that only ever appended
+// meant a revoked grant was still replayed (and re-Compact'd) after a
+// restart.
+func TestReplayIntoACLsReplaceDropsRevokedEntry(t *testing.T) {
+	snap := &frozenSnapshot{}
+
+	replayInto(snap, &frozenRecord{Seq: 1, ACLsReplace: &FrozenACLReplace{
+		ChannelId: 1,
+		Entries:   []*FrozenACL{{ChannelId: 1, Group: "all", Allow: PermissionWrite}},
+	}})
+	// A second channel's ACLs must be left alone by channel 1's replace.
+	replayInto(snap, &frozenRecord{Seq: 2, ACLsReplace: &FrozenACLReplace{
+		ChannelId: 2,
+		Entries:   []*FrozenACL{{ChannelId: 2, Group: "all", Allow: PermissionTraverse}},
+	}})
+	// Revoke everything on channel 1.
+	replayInto(snap, &frozenRecord{Seq: 3, ACLsReplace: &FrozenACLReplace{ChannelId: 1, Entries: nil}})
+
+	for _, acl := range snap.ACLs {
+		if acl.ChannelId == 1 {
+			t.Errorf("expected channel 1's revoked ACL to be gone, found %#v", acl)
+		}
+	}
+	if len(snap.ACLs) != 1 || snap.ACLs[0].ChannelId != 2 {
+		t.Errorf("expected channel 2's ACL to be untouched by channel 1's replace, got %#v", snap.ACLs)
+	}
+}
+
+func TestFreezeLogLoadReplaysLoggedState(t *testing.T) {
+	dir := os.TempDir() + "/grumble-freeze-test"
+	os.RemoveAll(dir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fl, err := NewFreezeLog(dir)
+	if err != nil {
+		t.Fatalf("NewFreezeLog: %v", err)
+	}
+
+	fl.UpdateFrozenChannel(&FrozenChannel{Id: 1, Name: "Root"})
+	fl.UpdateFrozenACLs(1, []*FrozenACL{{ChannelId: 1, Group: "all", Allow: PermissionWrite}})
+	// Revoke the grant before anything has been Compact'd.
+	fl.UpdateFrozenACLs(1, nil)
+
+	server := &Server{
+		channels: make(map[int]*Channel),
+		clients:  make(map[uint32]*Client),
+	}
+	if err := fl.Load(server); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	channel, ok := server.channels[1]
+	if !ok {
+		t.Fatalf("expected channel 1 to have been reconstructed from the log")
+	}
+	if len(channel.ACLs) != 0 {
+		t.Errorf("expected the revoked ACL to not be replayed back, got %#v", channel.ACLs)
+	}
+}
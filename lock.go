@@ -0,0 +1,22 @@
+// Grumble - an implementation of Murmur in Go
+// Copyright (c) 2010 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"sync"
+)
+
+// stateMu guards every mutation (and walk) of server.channels,
+// server.clients, server.bans and a Channel's ACLs/Groups/Users. The
+// native dispatch path serializes these naturally by handling one
+// client message at a time, but both the management RPC server (one
+// goroutine per connection, via net/rpc) and the bridge's HTTP API
+// (one goroutine per request, via net/http) call straight into the
+// same shared maps from arbitrary goroutines. Taking this lock in the
+// handful of functions that actually touch that state - rather than in
+// every caller - keeps all three paths safe without duplicating the
+// locking logic at each call site.
+var stateMu sync.Mutex
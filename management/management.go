@@ -0,0 +1,237 @@
+// Grumble - an implementation of Murmur in Go
+// Copyright (c) 2010 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+// Package management exposes grumble's server administration surface
+// (the operations Murmur offers scripts through its Ice interface) over
+// net/rpc, so operators can manage channels, users, bans and ACLs
+// without speaking the native Mumble wire protocol.
+package management
+
+import (
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"sync"
+)
+
+// Channel is the RPC projection of a grumble channel.
+type Channel struct {
+	Id       int32
+	Name     string
+	ParentId int32
+}
+
+// User is the RPC projection of a connected or registered grumble user.
+type User struct {
+	Session   uint32
+	Name      string
+	ChannelId int32
+}
+
+// Ban is the RPC projection of a ban list entry.
+type Ban struct {
+	Address string
+	Mask    int32
+	Reason  string
+}
+
+// ACL is the RPC projection of a channel's permission configuration.
+type ACL struct {
+	ChannelId int32
+	Allow     uint32
+	Deny      uint32
+	UserId    int32
+	Group     string
+}
+
+// Backend is implemented by the running server and is the only way
+// this package touches grumble's in-memory state, which keeps
+// management free of any dependency on package main.
+type Backend interface {
+	AddChannel(parentId int32, name string) (int32, os.Error)
+	RemoveChannel(id int32) os.Error
+	ListChannels() []Channel
+
+	ListUsers() []User
+	KickUser(session uint32, reason string) os.Error
+	BanUser(session uint32, reason string) os.Error
+
+	ListBans() []Ban
+	SetBans(bans []Ban) os.Error
+
+	SetACL(acl ACL) os.Error
+
+	// Subscribe registers a callback invoked for every
+	// user-connected, user-disconnected, user-state-changed and
+	// channel-created event. It returns an id that can be passed to
+	// Unsubscribe.
+	Subscribe(callback func(event string, payload interface{})) int
+	Unsubscribe(id int)
+}
+
+// Server is the net/rpc receiver exposing Backend over the wire. Every
+// exported method follows the net/rpc convention of (args, reply) with
+// an os.Error return.
+type Server struct {
+	backend Backend
+
+	mu     sync.Mutex
+	seq    int64
+	events []Event
+}
+
+// Event is a single administration event recorded for delivery to
+// PollEvents callers (user-connected, user-disconnected,
+// user-state-changed or channel-created).
+type Event struct {
+	Seq     int64
+	Kind    string
+	Payload interface{}
+}
+
+// eventBacklog bounds how many past events PollEvents callers can catch
+// up on; older events are dropped rather than kept forever.
+const eventBacklog = 1024
+
+// NewServer wraps backend for export over RPC. It subscribes to
+// backend's events so PollEvents callers can catch up on everything
+// that happened since their last poll, emulating Ice's callback
+// delivery without requiring a persistent connection.
+func NewServer(backend Backend) *Server {
+	s := &Server{backend: backend}
+	backend.Subscribe(func(kind string, payload interface{}) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.seq++
+		s.events = append(s.events, Event{Seq: s.seq, Kind: kind, Payload: payload})
+		if len(s.events) > eventBacklog {
+			s.events = s.events[len(s.events)-eventBacklog:]
+		}
+	})
+	return s
+}
+
+// ListenAndServe registers Server under the "Management" RPC name and
+// serves net/rpc requests on addr until an error occurs.
+func ListenAndServe(addr string, backend Backend) os.Error {
+	mgmt := NewServer(backend)
+
+	rpcServer := rpc.NewServer()
+	if err := rpcServer.RegisterName("Management", mgmt); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("management: listening on %v", addr)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go rpcServer.ServeConn(conn)
+	}
+	panic("unreachable")
+}
+
+type AddChannelArgs struct {
+	ParentId int32
+	Name     string
+}
+
+func (s *Server) AddChannel(args *AddChannelArgs, reply *int32) os.Error {
+	id, err := s.backend.AddChannel(args.ParentId, args.Name)
+	if err != nil {
+		return err
+	}
+	*reply = id
+	return nil
+}
+
+func (s *Server) RemoveChannel(id *int32, reply *bool) os.Error {
+	if err := s.backend.RemoveChannel(*id); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
+func (s *Server) ListChannels(args *struct{}, reply *[]Channel) os.Error {
+	*reply = s.backend.ListChannels()
+	return nil
+}
+
+func (s *Server) ListUsers(args *struct{}, reply *[]User) os.Error {
+	*reply = s.backend.ListUsers()
+	return nil
+}
+
+type KickArgs struct {
+	Session uint32
+	Reason  string
+}
+
+func (s *Server) Kick(args *KickArgs, reply *bool) os.Error {
+	if err := s.backend.KickUser(args.Session, args.Reason); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
+func (s *Server) Ban(args *KickArgs, reply *bool) os.Error {
+	if err := s.backend.BanUser(args.Session, args.Reason); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
+func (s *Server) ListBans(args *struct{}, reply *[]Ban) os.Error {
+	*reply = s.backend.ListBans()
+	return nil
+}
+
+func (s *Server) SetBans(bans *[]Ban, reply *bool) os.Error {
+	if err := s.backend.SetBans(*bans); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
+func (s *Server) SetACL(acl *ACL, reply *bool) os.Error {
+	if err := s.backend.SetACL(*acl); err != nil {
+		return err
+	}
+	*reply = true
+	return nil
+}
+
+// PollReply is returned by PollEvents: the events since the caller's
+// cursor, and the cursor to pass on the next call.
+type PollReply struct {
+	Events []Event
+	Next   int64
+}
+
+// PollEvents returns every event recorded after since, letting a
+// management client emulate a callback stream by polling.
+func (s *Server) PollEvents(since *int64, reply *PollReply) os.Error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, ev := range s.events {
+		if ev.Seq > *since {
+			reply.Events = append(reply.Events, ev)
+		}
+	}
+	reply.Next = s.seq
+	return nil
+}
@@ -0,0 +1,206 @@
+// Grumble - an implementation of Murmur in Go
+// Copyright (c) 2010 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"management"
+	"os"
+	"sync"
+)
+
+// adminEvents fans out user-connected, user-disconnected,
+// user-state-changed and channel-created notifications to the
+// management package, which turns them into pollable Events for RPC
+// clients. It is deliberately package-level since grumble runs a
+// single Server per process.
+var adminEvents = struct {
+	sync.Mutex
+	callbacks map[int]func(string, interface{})
+	next      int
+}{callbacks: make(map[int]func(string, interface{}))}
+
+func notifyAdmin(kind string, payload interface{}) {
+	adminEvents.Lock()
+	defer adminEvents.Unlock()
+	for _, cb := range adminEvents.callbacks {
+		cb(kind, payload)
+	}
+}
+
+// managementBackend adapts *Server to management.Backend.
+type managementBackend struct {
+	server *Server
+}
+
+// Every method below runs on its own net/rpc-per-connection goroutine,
+// so each either takes stateMu itself around a direct map touch, or
+// calls one of the already-locking shared helpers in serverops.go /
+// bridge.go / acl.go (never both, to avoid deadlocking on a mutex
+// that isn't reentrant).
+
+func (b *managementBackend) AddChannel(parentId int32, name string) (int32, os.Error) {
+	stateMu.Lock()
+	parent := b.server.channels[int(parentId)]
+	if parent == nil {
+		stateMu.Unlock()
+		return 0, os.NewError("no such parent channel")
+	}
+	channel := b.server.addChannelLocked(parent, name)
+	stateMu.Unlock()
+
+	b.server.broadcastChannelState(channel)
+	notifyAdmin("channel-created", management.Channel{Id: int32(channel.Id), Name: channel.Name, ParentId: parentId})
+	return int32(channel.Id), nil
+}
+
+func (b *managementBackend) RemoveChannel(id int32) os.Error {
+	stateMu.Lock()
+	channel := b.server.channels[int(id)]
+	if channel == nil || channel == b.server.root {
+		stateMu.Unlock()
+		return os.NewError("no such channel")
+	}
+	b.server.removeChannelLocked(channel)
+	stateMu.Unlock()
+	return nil
+}
+
+func (b *managementBackend) ListChannels() []management.Channel {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	channels := []management.Channel{}
+	for id, channel := range b.server.channels {
+		parentId := int32(0)
+		if channel.Parent != nil {
+			parentId = int32(channel.Parent.Id)
+		}
+		channels = append(channels, management.Channel{Id: int32(id), Name: channel.Name, ParentId: parentId})
+	}
+	return channels
+}
+
+func (b *managementBackend) ListUsers() []management.User {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	users := []management.User{}
+	for session, client := range b.server.clients {
+		channelId := int32(-1)
+		if client.Channel != nil {
+			channelId = int32(client.Channel.Id)
+		}
+		users = append(users, management.User{Session: session, Name: client.Username, ChannelId: channelId})
+	}
+	return users
+}
+
+func (b *managementBackend) KickUser(session uint32, reason string) os.Error {
+	stateMu.Lock()
+	client, ok := b.server.clients[session]
+	stateMu.Unlock()
+	if !ok {
+		return os.NewError("no such session")
+	}
+
+	b.server.DisconnectClient(client)
+	notifyAdmin("user-disconnected", management.User{Session: session, Name: client.Username})
+	return nil
+}
+
+func (b *managementBackend) BanUser(session uint32, reason string) os.Error {
+	stateMu.Lock()
+	client, ok := b.server.clients[session]
+	if !ok {
+		stateMu.Unlock()
+		return os.NewError("no such session")
+	}
+	b.server.bans = append(b.server.bans, &Ban{Address: client.Address, Reason: reason})
+	if b.server.freeze != nil {
+		b.server.freeze.UpdateFrozenBans(frozenBansOf(b.server.bans))
+	}
+	stateMu.Unlock()
+
+	b.server.DisconnectClient(client)
+	notifyAdmin("user-disconnected", management.User{Session: session, Name: client.Username})
+	return nil
+}
+
+func (b *managementBackend) ListBans() []management.Ban {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	bans := []management.Ban{}
+	for _, ban := range b.server.bans {
+		bans = append(bans, management.Ban{Address: ban.Address, Mask: int32(ban.Mask), Reason: ban.Reason})
+	}
+	return bans
+}
+
+func (b *managementBackend) SetBans(bans []management.Ban) os.Error {
+	newBans := []*Ban{}
+	for _, ban := range bans {
+		newBans = append(newBans, &Ban{Address: ban.Address, Mask: int(ban.Mask), Reason: ban.Reason})
+	}
+
+	stateMu.Lock()
+	b.server.bans = newBans
+	if b.server.freeze != nil {
+		b.server.freeze.UpdateFrozenBans(frozenBansOf(newBans))
+	}
+	stateMu.Unlock()
+	return nil
+}
+
+// frozenBansOf projects bans into their on-disk representation, for
+// callers that need to log the whole list as a unit (BanUser, SetBans).
+func frozenBansOf(bans []*Ban) []*FrozenBan {
+	frozen := []*FrozenBan{}
+	for _, ban := range bans {
+		frozen = append(frozen, &FrozenBan{Address: ban.Address, Mask: ban.Mask, Reason: ban.Reason})
+	}
+	return frozen
+}
+
+func (b *managementBackend) SetACL(acl management.ACL) os.Error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	channel := b.server.channels[int(acl.ChannelId)]
+	if channel == nil {
+		return os.NewError("no such channel")
+	}
+
+	entry := NewChanACL()
+	entry.Allow = Permission(acl.Allow)
+	entry.Deny = Permission(acl.Deny)
+	if acl.Group != "" {
+		entry.Group = acl.Group
+	} else {
+		entry.UserId = int(acl.UserId)
+	}
+	channel.ACLs = append(channel.ACLs, entry)
+	flushACLCache()
+	if b.server.freeze != nil {
+		b.server.freeze.UpdateFrozenACLs(channel.Id, frozenACLsOf(channel))
+	}
+	return nil
+}
+
+func (b *managementBackend) Subscribe(callback func(string, interface{})) int {
+	adminEvents.Lock()
+	defer adminEvents.Unlock()
+	adminEvents.next++
+	id := adminEvents.next
+	adminEvents.callbacks[id] = callback
+	return id
+}
+
+func (b *managementBackend) Unsubscribe(id int) {
+	adminEvents.Lock()
+	defer adminEvents.Unlock()
+	adminEvents.callbacks[id] = nil, false
+}
@@ -7,6 +7,7 @@ package main
 
 import (
 	"log"
+	"management"
 	"mumbleproto"
 	"goprotobuf.googlecode.com/hg/proto"
 	"net"
@@ -48,6 +49,16 @@ const (
 	UDPMessagePing
 	UDPMessageVoiceSpeex
 	UDPMessageVoiceCELTBeta
+	UDPMessageVoiceOpus
+)
+
+// Voice target slot ids, as they appear in the target byte of a voice
+// packet's header.
+const (
+	VoiceTargetNormal   = 0
+	VoiceTargetMinSlot  = 1
+	VoiceTargetMaxSlot  = 30
+	VoiceTargetLoopback = 31
 )
 
 type Message struct {
@@ -125,15 +136,155 @@ func (server *Server) handlePingMessage(client *Client, msg *Message) {
 }
 
 func (server *Server) handleChannelAddMessage(client *Client, msg *Message) {
+	chanstate := &mumbleproto.ChannelState{}
+	err := proto.Unmarshal(msg.buf, chanstate)
+	if err != nil {
+		client.Panic(err.String())
+		return
+	}
+
+	if chanstate.Parent == nil || chanstate.Name == nil {
+		return
+	}
+	parent := server.channels[int(*chanstate.Parent)]
+	if parent == nil {
+		return
+	}
+
+	if !HasPermission(parent, client, PermissionMakeChannel) {
+		client.sendPermissionDenied(client, parent, PermissionMakeChannel)
+		return
+	}
+
+	channel := server.AddChannel(parent, *chanstate.Name)
+
+	server.broadcastChannelState(channel)
+	notifyAdmin("channel-created", management.Channel{Id: int32(channel.Id), Name: channel.Name, ParentId: int32(parent.Id)})
 }
 
 func (server *Server) handleChannelRemoveMessage(client *Client, msg *Message) {
+	chanstate := &mumbleproto.ChannelState{}
+	err := proto.Unmarshal(msg.buf, chanstate)
+	if err != nil {
+		client.Panic(err.String())
+		return
+	}
+
+	if chanstate.ChannelId == nil {
+		return
+	}
+	channel := server.channels[int(*chanstate.ChannelId)]
+	if channel == nil || channel == server.root {
+		return
+	}
+
+	if !HasPermission(channel, client, PermissionWrite) {
+		client.sendPermissionDenied(client, channel, PermissionWrite)
+		return
+	}
+
+	server.RemoveChannel(channel)
+
+	for _, c := range server.clients {
+		c.sendProtoMessage(MessageChannelRemove, &mumbleproto.ChannelRemove{
+			ChannelId: proto.Uint32(uint32(channel.Id)),
+		})
+	}
 }
 
 func (server *Server) handleChannelStateMessage(client *Client, msg *Message) {
+	chanstate := &mumbleproto.ChannelState{}
+	err := proto.Unmarshal(msg.buf, chanstate)
+	if err != nil {
+		client.Panic(err.String())
+		return
+	}
+
+	if chanstate.ChannelId == nil {
+		return
+	}
+	channel := server.channels[int(*chanstate.ChannelId)]
+	if channel == nil {
+		return
+	}
+
+	if !HasPermission(channel, client, PermissionWrite) {
+		client.sendPermissionDenied(client, channel, PermissionWrite)
+		return
+	}
+
+	if chanstate.Name != nil {
+		channel.Name = *chanstate.Name
+		if server.freeze != nil {
+			parentId := 0
+			if channel.Parent != nil {
+				parentId = channel.Parent.Id
+			}
+			server.freeze.UpdateFrozenChannel(&FrozenChannel{Id: channel.Id, Name: channel.Name, ParentId: parentId})
+		}
+	}
+
+	server.broadcastChannelState(channel)
+}
+
+// broadcastChannelState sends the current state of channel to every
+// connected client and, if a bridge is attached, publishes the same
+// event to its subscribers.
+func (server *Server) broadcastChannelState(channel *Channel) {
+	parentId := uint32(0)
+	if channel.Parent != nil {
+		parentId = uint32(channel.Parent.Id)
+	}
+	chanstate := &mumbleproto.ChannelState{
+		ChannelId: proto.Uint32(uint32(channel.Id)),
+		Parent:    proto.Uint32(parentId),
+		Name:      proto.String(channel.Name),
+	}
+
+	for _, c := range server.clients {
+		c.sendProtoMessage(MessageChannelState, chanstate)
+	}
+
+	if server.bridge != nil {
+		server.bridge.Publish(BridgeEvent{Kind: "ChannelState", Payload: chanstate})
+	}
 }
 
 func (server *Server) handleUserRemoveMessage(client *Client, msg *Message) {
+	userremove := &mumbleproto.UserRemove{}
+	err := proto.Unmarshal(msg.buf, userremove)
+	if err != nil {
+		client.Panic(err.String())
+		return
+	}
+
+	if userremove.Session == nil {
+		return
+	}
+	user, ok := server.clients[*userremove.Session]
+	if !ok {
+		return
+	}
+
+	if userremove.Ban != nil && *userremove.Ban {
+		if !HasPermission(server.root, client, PermissionBan) {
+			client.sendPermissionDenied(client, server.root, PermissionBan)
+			return
+		}
+		server.bans = append(server.bans, &Ban{Address: user.Address, Reason: userremove.GetReason()})
+		if server.freeze != nil {
+			server.freeze.UpdateFrozenBans(frozenBansOf(server.bans))
+		}
+	} else {
+		if !HasPermission(server.root, client, PermissionKick) {
+			client.sendPermissionDenied(client, server.root, PermissionKick)
+			return
+		}
+	}
+
+	userremove.Actor = proto.Uint32(client.Session)
+	user.sendProtoMessage(MessageUserRemove, userremove)
+	server.DisconnectClient(user)
 }
 
 func (server *Server) handleUserStateMessage(client *Client, msg *Message) {
@@ -166,19 +317,50 @@ func (server *Server) handleUserStateMessage(client *Client, msg *Message) {
 
 		// If the user and the actor aren't the same, check whether the actor has the 'move' permission
 		// on the user's channel to move.
+		if user != actor && !HasPermission(user.Channel, actor, PermissionMove) {
+			client.sendPermissionDenied(actor, user.Channel, PermissionMove)
+			return
+		}
 
 		// Check whether the actor has 'move' permissions on dstChan.  Check whether user has 'enter'
 		// permissions on dstChan.
+		if !HasPermission(dstChan, actor, PermissionMove) {
+			client.sendPermissionDenied(actor, dstChan, PermissionMove)
+			return
+		}
+		if !HasPermission(dstChan, user, PermissionEnter) {
+			client.sendPermissionDenied(user, dstChan, PermissionEnter)
+			return
+		}
 
 		// Check whether the channel is full.
+		if dstChan.MaxUsers > 0 && len(dstChan.Users) >= dstChan.MaxUsers {
+			client.sendPermissionDenied(actor, dstChan, PermissionEnter)
+			return
+		}
+
+		server.moveUserToChannel(user, dstChan)
+		server.freezeUser(user)
 	}
 
 	if userstate.Mute != nil || userstate.Deaf != nil || userstate.Suppress != nil || userstate.PrioritySpeaker != nil {
 		// Disallow for SuperUser
+		if user.UserId == 0 {
+			return
+		}
 
 		// Check whether the actor has 'mutedeafen' permission on user's channel.
+		if actor != user && !HasPermission(user.Channel, actor, PermissionMuteDeafen) {
+			client.sendPermissionDenied(actor, user.Channel, PermissionMuteDeafen)
+			return
+		}
 
 		// Check if this was a suppress operation. Only the server can suppress users.
+		if userstate.Suppress != nil {
+			userstate.Suppress = nil
+		}
+
+		server.freezeUser(user)
 	}
 
 	// Comment set/clear
@@ -190,28 +372,60 @@ func (server *Server) handleUserStateMessage(client *Client, msg *Message) {
 		if user != actor {
 			// Check if actor has 'move' permissions on the root channel. It is needed
 			// to clear another user's comment.
+			if !HasPermission(server.root, actor, PermissionMove) {
+				client.sendPermissionDenied(actor, server.root, PermissionMove)
+				return
+			}
 
 			// Only allow empty text.
+			if len(comment) > 0 {
+				return
+			}
 		}
 
 		// Check if the text is allowed.
+		if len(comment) > server.MaxTextMessageLength {
+			return
+		}
 
 		// Only set the comment if it is different from the current
 		// user comment.
+		if comment != user.Comment {
+			user.Comment = comment
+			server.freezeUser(user)
+		}
 	}
 
 	// Texture change
 	if userstate.Texture != nil {
 		// Check the length of the texture
+		if len(userstate.Texture) > server.MaxImageMessageLength {
+			return
+		}
+		server.freezeUser(user)
 	}
 
 	// Registration
 	if userstate.UserId != nil {
 		// If user == actor, check for 'selfregister' permission on root channel.
 		// If user != actor, check for 'register' permission on root channel.
+		if user == actor {
+			if !HasPermission(server.root, actor, PermissionSelfRegister) {
+				client.sendPermissionDenied(actor, server.root, PermissionSelfRegister)
+				return
+			}
+		} else if !HasPermission(server.root, actor, PermissionRegister) {
+			client.sendPermissionDenied(actor, server.root, PermissionRegister)
+			return
+		}
 
 		// Check if the UserId in the message is >= 0. A registration attempt
 		// must use a negative UserId.
+		if int32(*userstate.UserId) >= 0 {
+			return
+		}
+
+		server.freezeUser(user)
 	}
 
 	// Prevent self-targetting state changes to be applied to other users
@@ -229,9 +443,77 @@ func (server *Server) handleUserStateMessage(client *Client, msg *Message) {
 			return
 	}
 
+	// Broadcast whichever of the non-move fields above were sent and
+	// passed their permission check (the function would have returned
+	// earlier otherwise), so every client - including the actor itself -
+	// sees the change take effect. ChannelId is left out: a channel move
+	// already broadcasts its own UserState via moveUserToChannelLocked.
+	broadcast := &mumbleproto.UserState{
+		Session:         userstate.Session,
+		Actor:           userstate.Actor,
+		Comment:         userstate.Comment,
+		Texture:         userstate.Texture,
+		Mute:            userstate.Mute,
+		Deaf:            userstate.Deaf,
+		Suppress:        userstate.Suppress,
+		PrioritySpeaker: userstate.PrioritySpeaker,
+		UserId:          userstate.UserId,
+		SelfMute:        userstate.SelfMute,
+		SelfDeaf:        userstate.SelfDeaf,
+		PluginContext:   userstate.PluginContext,
+		PluginIdentity:  userstate.PluginIdentity,
+		Recording:       userstate.Recording,
+	}
+	for _, c := range server.clients {
+		c.sendProtoMessage(MessageUserState, broadcast)
+	}
+
+	if server.bridge != nil {
+		server.bridge.Publish(BridgeEvent{Kind: "UserState", Payload: userstate})
+	}
+	notifyAdmin("user-state-changed", management.User{Session: user.Session, Name: user.Username, ChannelId: int32(user.Channel.Id)})
 }
 
 func (server *Server) handleBanListMessage(client *Client, msg *Message) {
+	banlist := &mumbleproto.BanList{}
+	err := proto.Unmarshal(msg.buf, banlist)
+	if err != nil {
+		client.Panic(err.String())
+		return
+	}
+
+	if !HasPermission(server.root, client, PermissionBan) {
+		client.sendPermissionDenied(client, server.root, PermissionBan)
+		return
+	}
+
+	// A BanList with entries is an edit; a query has none and expects
+	// the current list echoed back.
+	if len(banlist.Bans) > 0 {
+		bans := []*Ban{}
+		for _, entry := range banlist.Bans {
+			bans = append(bans, &Ban{
+				Address: entry.GetAddress(),
+				Mask:    int(entry.GetMask()),
+				Reason:  entry.GetReason(),
+			})
+		}
+		server.bans = bans
+		if server.freeze != nil {
+			server.freeze.UpdateFrozenBans(frozenBansOf(bans))
+		}
+		return
+	}
+
+	reply := &mumbleproto.BanList{}
+	for _, ban := range server.bans {
+		reply.Bans = append(reply.Bans, &mumbleproto.BanList_BanEntry{
+			Address: proto.String(ban.Address),
+			Mask:    proto.Uint32(uint32(ban.Mask)),
+			Reason:  proto.String(ban.Reason),
+		})
+	}
+	client.sendProtoMessage(MessageBanList, reply)
 }
 
 func (server *Server) handleTextMessage(client *Client, msg *Message) {
@@ -242,28 +524,111 @@ func (server *Server) handleTextMessage(client *Client, msg *Message) {
 		return
 	}
 
+	server.deliverTextMessage(client, txtmsg)
+}
+
+// deliverTextMessage fans txtmsg out to the sessions and channels it
+// names, rewriting the Actor to client's session. This is the single
+// path all text messages flow through, whether they originate from a
+// native client's handleTextMessage (dispatched one at a time, holding
+// no lock of its own) or from the bridge's HTTP handlers, which run on
+// their own per-request goroutine, so this takes stateMu itself.
+func (server *Server) deliverTextMessage(client *Client, txtmsg *mumbleproto.TextMessage) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
 	users := []*Client{}
 	for i := 0; i < len(txtmsg.Session); i++ {
 		user, ok := server.clients[txtmsg.Session[i]]
 		if !ok {
-			log.Panic("Could not look up client by session")
+			continue
+		}
+		if !HasPermission(user.Channel, client, PermissionTextMessage) {
+			client.sendPermissionDenied(client, user.Channel, PermissionTextMessage)
+			continue
 		}
 		users = append(users, user)
 	}
 
+	for i := 0; i < len(txtmsg.ChannelId); i++ {
+		channel := server.channels[int(txtmsg.ChannelId[i])]
+		if channel == nil {
+			continue
+		}
+		if !HasPermission(channel, client, PermissionTextMessage) {
+			client.sendPermissionDenied(client, channel, PermissionTextMessage)
+			continue
+		}
+		for _, user := range channel.Users {
+			users = append(users, user)
+		}
+	}
+
 	for _, user := range users {
 		user.sendProtoMessage(MessageTextMessage, &mumbleproto.TextMessage{
 			Actor:   proto.Uint32(client.Session),
 			Message: txtmsg.Message,
 		})
 	}
+
+	if server.bridge != nil {
+		server.bridge.Publish(BridgeEvent{Kind: "TextMessage", Payload: txtmsg})
+	}
 }
 
 func (server *Server) handleAclMessage(client *Client, msg *Message) {
+	acl := &mumbleproto.ACL{}
+	err := proto.Unmarshal(msg.buf, acl)
+	if err != nil {
+		client.Panic(err.String())
+		return
+	}
+
+	if acl.ChannelId == nil {
+		return
+	}
+	channel := server.channels[int(*acl.ChannelId)]
+	if channel == nil {
+		return
+	}
+
+	if !HasPermission(channel, client, PermissionWrite) {
+		client.sendPermissionDenied(client, channel, PermissionWrite)
+		return
+	}
+
+	server.ApplyACL(channel, acl)
+	client.sendProtoMessage(MessageACL, server.MessageACL(channel))
 }
 
 // User query
 func (server *Server) handleQueryUsers(client *Client, msg *Message) {
+	query := &mumbleproto.QueryUsers{}
+	err := proto.Unmarshal(msg.buf, query)
+	if err != nil {
+		client.Panic(err.String())
+		return
+	}
+
+	reply := &mumbleproto.QueryUsers{}
+	for _, id := range query.Ids {
+		user, ok := server.registrations[int(id)]
+		if !ok {
+			continue
+		}
+		reply.Ids = append(reply.Ids, id)
+		reply.Names = append(reply.Names, user.Name)
+	}
+	for _, name := range query.Names {
+		id, ok := server.registrationIdByName[name]
+		if !ok {
+			continue
+		}
+		reply.Ids = append(reply.Ids, uint32(id))
+		reply.Names = append(reply.Names, name)
+	}
+
+	client.sendProtoMessage(MessageQueryUsers, reply)
 }
 
 // User stats message. Shown in the Mumble client when a
@@ -276,3 +641,109 @@ func (server *Server) handleUserStatsMessage(client *Client, msg *Message) {
 	}
 	log.Printf("UserStatsMessage")
 }
+
+// handleCodecVersion negotiates the codec clients should use: Opus if
+// every connected client has reported Opus support in its
+// CodecVersion, otherwise the CELT version supported by the most
+// CELT-only clients, the highest one on a tie (so the highest version
+// they all have in common, when there is one). The server
+// broadcasts a CodecVersion to all clients whenever the negotiated
+// version changes.
+func (server *Server) handleCodecVersion(client *Client, msg *Message) {
+	codec := &mumbleproto.CodecVersion{}
+	err := proto.Unmarshal(msg.buf, codec)
+	if err != nil {
+		client.Panic(err.String())
+		return
+	}
+
+	client.codecOpus = codec.GetOpus()
+	client.codecAlpha = codec.GetAlpha()
+	client.codecBeta = codec.GetBeta()
+	client.codecPreferAlpha = codec.GetPreferAlpha()
+
+	negotiated := server.negotiateCodecVersion()
+	if negotiated.GetAlpha() != server.currentCodec.GetAlpha() ||
+		negotiated.GetBeta() != server.currentCodec.GetBeta() ||
+		negotiated.GetPreferAlpha() != server.currentCodec.GetPreferAlpha() ||
+		negotiated.GetOpus() != server.currentCodec.GetOpus() {
+		server.currentCodec = negotiated
+		for _, c := range server.clients {
+			c.sendProtoMessage(MessageCodecVersion, negotiated)
+		}
+	}
+}
+
+// negotiateCodecVersion picks Opus if every connected client supports
+// it, and otherwise falls back to the CELT version shared by the
+// widest number of CELT-only clients (the highest such version on a
+// tie), matching how Murmur downgrades a room when an older client
+// joins.
+func (server *Server) negotiateCodecVersion() *mumbleproto.CodecVersion {
+	allOpus := true
+	alphaVotes := make(map[int32]int)
+	for _, c := range server.clients {
+		if !c.codecOpus {
+			allOpus = false
+			alphaVotes[c.codecAlpha]++
+			if c.codecBeta != c.codecAlpha {
+				alphaVotes[c.codecBeta]++
+			}
+		}
+	}
+
+	if allOpus {
+		return &mumbleproto.CodecVersion{Opus: proto.Bool(true)}
+	}
+
+	best := int32(-1)
+	bestVotes := -1
+	for version, votes := range alphaVotes {
+		if votes > bestVotes || (votes == bestVotes && version > best) {
+			best = version
+			bestVotes = votes
+		}
+	}
+
+	return &mumbleproto.CodecVersion{
+		Alpha:       proto.Int32(best),
+		Beta:        proto.Int32(best),
+		PreferAlpha: proto.Bool(true),
+		Opus:        proto.Bool(false),
+	}
+}
+
+// handleVoiceTarget records the VoiceTarget slots a client sent via
+// MessageVoiceTarget, for later use by the voice router to resolve
+// whisper targets.
+func (server *Server) handleVoiceTarget(client *Client, msg *Message) {
+	vt := &mumbleproto.VoiceTarget{}
+	err := proto.Unmarshal(msg.buf, vt)
+	if err != nil {
+		client.Panic(err.String())
+		return
+	}
+
+	if vt.Id == nil || *vt.Id < VoiceTargetMinSlot || *vt.Id > VoiceTargetMaxSlot {
+		return
+	}
+
+	target := &VoiceTarget{}
+	for _, t := range vt.Targets {
+		entry := VoiceTargetEntry{Group: t.GetGroup()}
+		for _, session := range t.Session {
+			entry.Sessions = append(entry.Sessions, session)
+		}
+		for _, channelId := range t.ChannelId {
+			entry.Channels = append(entry.Channels, int(channelId))
+		}
+		entry.Links = t.GetLinks()
+		entry.Children = t.GetChildren()
+		target.Entries = append(target.Entries, entry)
+	}
+
+	if client.targets == nil {
+		client.targets = make(map[byte]*VoiceTarget)
+	}
+	client.targets[byte(*vt.Id)] = target
+}
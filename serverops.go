@@ -0,0 +1,81 @@
+// Grumble - an implementation of Murmur in Go
+// Copyright (c) 2010 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// AddChannel creates a new child channel of parent named name and
+// links it into the channel tree. It is the single path used whether
+// the creation was requested by a native client's ChannelAdd message
+// or by the management RPC surface.
+func (server *Server) AddChannel(parent *Channel, name string) *Channel {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	return server.addChannelLocked(parent, name)
+}
+
+func (server *Server) addChannelLocked(parent *Channel, name string) *Channel {
+	id := server.nextChannelId
+	server.nextChannelId++
+
+	channel := &Channel{
+		Id:     id,
+		Name:   name,
+		Parent: parent,
+		Users:  make(map[uint32]*Client),
+		Groups: make(map[string]*Group),
+	}
+	parent.Children = append(parent.Children, channel)
+	server.channels[id] = channel
+
+	if server.freeze != nil {
+		server.freeze.UpdateFrozenChannel(&FrozenChannel{Id: id, Name: name, ParentId: parent.Id})
+	}
+
+	return channel
+}
+
+// RemoveChannel unlinks channel from its parent and the server's
+// channel map, moving any users still in it to the parent channel.
+func (server *Server) RemoveChannel(channel *Channel) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	server.removeChannelLocked(channel)
+}
+
+func (server *Server) removeChannelLocked(channel *Channel) {
+	for _, user := range channel.Users {
+		server.moveUserToChannelLocked(user, channel.Parent)
+	}
+
+	if channel.Parent != nil {
+		children := []*Channel{}
+		for _, c := range channel.Parent.Children {
+			if c != channel {
+				children = append(children, c)
+			}
+		}
+		channel.Parent.Children = children
+	}
+
+	server.channels[channel.Id] = nil, false
+	flushACLCache()
+
+	if server.freeze != nil {
+		server.freeze.RemoveFrozenChannel(channel.Id)
+	}
+}
+
+// DisconnectClient closes client's connection and removes it from the
+// server's client map and its current channel.
+func (server *Server) DisconnectClient(client *Client) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+
+	if client.Channel != nil {
+		client.Channel.Users[client.Session] = nil, false
+	}
+	server.clients[client.Session] = nil, false
+	client.Close()
+}
@@ -0,0 +1,164 @@
+// Grumble - an implementation of Murmur in Go
+// Copyright (c) 2010 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+// VoiceTargetEntry describes one piece of a VoiceTarget slot: either an
+// explicit set of sessions, or a channel (optionally including linked
+// channels and/or sub-channels), optionally restricted to a group.
+type VoiceTargetEntry struct {
+	Sessions []uint32
+	Channels []int
+	Group    string
+	Links    bool
+	Children bool
+}
+
+// VoiceTarget is the full set of recipients a client's whisper slot
+// (1..30) resolves to, as last configured via MessageVoiceTarget.
+type VoiceTarget struct {
+	Entries []VoiceTargetEntry
+}
+
+// resolveVoiceTarget resolves target against the current channel tree,
+// honoring whether sender holds Speak/Whisper ACL on each candidate
+// recipient's channel before including them.
+func (server *Server) resolveVoiceTarget(sender *Client, target *VoiceTarget) []*Client {
+	seen := make(map[uint32]bool)
+	recipients := []*Client{}
+
+	add := func(user *Client) {
+		if user == sender || seen[user.Session] {
+			return
+		}
+		perm := PermissionWhisper
+		if user.Channel == sender.Channel {
+			perm = PermissionSpeak
+		}
+		if !HasPermission(user.Channel, sender, perm) {
+			return
+		}
+		seen[user.Session] = true
+		recipients = append(recipients, user)
+	}
+
+	for _, entry := range target.Entries {
+		for _, session := range entry.Sessions {
+			if user, ok := server.clients[session]; ok {
+				add(user)
+			}
+		}
+
+		for _, channelId := range entry.Channels {
+			channel, ok := server.channels[channelId]
+			if !ok {
+				continue
+			}
+			server.walkVoiceTargetChannel(channel, entry, add)
+		}
+	}
+
+	return recipients
+}
+
+// walkVoiceTargetChannel visits channel, its linked channels (if
+// entry.Links is set) and its sub-channels (if entry.Children is set),
+// calling add for every member that matches entry.Group.
+func (server *Server) walkVoiceTargetChannel(channel *Channel, entry VoiceTargetEntry, add func(*Client)) {
+	for _, user := range channel.Users {
+		if entry.Group == "" || inGroup(channel, user, entry.Group) {
+			add(user)
+		}
+	}
+
+	if entry.Links {
+		for _, linked := range channel.Links {
+			for _, user := range linked.Users {
+				if entry.Group == "" || inGroup(linked, user, entry.Group) {
+					add(user)
+				}
+			}
+		}
+	}
+
+	if entry.Children {
+		for _, child := range channel.Children {
+			server.walkVoiceTargetChannel(child, entry, add)
+		}
+	}
+}
+
+// varint encodes v as a Mumble-protocol variable length integer,
+// appending it to buf.
+func varint(buf []byte, v uint64) []byte {
+	switch {
+	case v < 0x80:
+		return append(buf, byte(v))
+	case v < 0x4000:
+		return append(buf, byte(v>>8)|0x80, byte(v))
+	case v < 0x200000:
+		return append(buf, byte(v>>16)|0xc0, byte(v>>8), byte(v))
+	case v < 0x10000000:
+		return append(buf, byte(v>>24)|0xe0, byte(v>>16), byte(v>>8), byte(v))
+	case v < 0x100000000:
+		return append(buf, 0xf0, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+	return append(buf, 0xf4, byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32),
+		byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// VoiceRouter consumes VoiceBroadcasts forever, resolving the target
+// byte to a recipient set and forwarding the packet to each of them,
+// prefixed with the sender's session id as the wire format requires.
+// Run it in its own goroutine for the lifetime of the server.
+func (server *Server) VoiceRouter(broadcasts chan *VoiceBroadcast) {
+	for vb := range broadcasts {
+		sender := vb.client
+
+		var recipients []*Client
+		switch {
+		case vb.target == VoiceTargetNormal:
+			if !HasPermission(sender.Channel, sender, PermissionSpeak) {
+				continue
+			}
+			for _, user := range sender.Channel.Users {
+				if user != sender {
+					recipients = append(recipients, user)
+				}
+			}
+
+		case vb.target == VoiceTargetLoopback:
+			recipients = []*Client{sender}
+
+		case vb.target >= VoiceTargetMinSlot && vb.target <= VoiceTargetMaxSlot:
+			target, ok := sender.targets[vb.target]
+			if !ok {
+				continue
+			}
+			recipients = server.resolveVoiceTarget(sender, target)
+
+		default:
+			continue
+		}
+
+		packet := append([]byte{vb.buf[0]}, varint(nil, uint64(sender.Session))...)
+		packet = append(packet, vb.buf[1:]...)
+
+		for _, user := range recipients {
+			server.sendVoicePacket(user, packet)
+		}
+	}
+}
+
+// sendVoicePacket delivers packet to user's confirmed UDP address, or
+// falls back to tunneling it over the user's TCP connection via
+// MessageUDPTunnel if UDP connectivity has not been established.
+func (server *Server) sendVoicePacket(user *Client, packet []byte) {
+	if user.udpConfirmed {
+		server.sendUDP(user, packet)
+		return
+	}
+	user.sendMessage(&Message{kind: MessageUDPTunnel, buf: packet})
+}
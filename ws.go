@@ -0,0 +1,157 @@
+// Grumble - an implementation of Murmur in Go
+// Copyright (c) 2010 The Grumble Authors
+// The use of this source code is goverened by a BSD-style
+// license that can be found in the LICENSE-file.
+
+package main
+
+import (
+	"binary"
+	"bytes"
+	"http"
+	"log"
+	"os"
+	"websocket"
+)
+
+// WebSocketConfig holds the config knobs for the browser-facing
+// listener: where it binds, the TLS cert/key pair it terminates with
+// (browsers require WSS for a page served over HTTPS), and an optional
+// allowlist of Origin headers. An empty AllowedOrigins accepts any
+// origin.
+type WebSocketConfig struct {
+	ListenAddr     string
+	CertFile       string
+	KeyFile        string
+	AllowedOrigins []string
+}
+
+// WebSocketServer accepts browser WebSocket connections and frames
+// them exactly like the TLS TCP listener does: a 2-byte message kind,
+// a 4-byte big-endian length, then the protobuf payload. This lets a
+// browser client be handled by server.dispatch without any special
+// casing. UDP voice isn't reachable from a browser at all, so voice
+// packets are expected to arrive wrapped in MessageUDPTunnel instead.
+type WebSocketServer struct {
+	server *Server
+	config WebSocketConfig
+}
+
+// NewWebSocketServer creates a WebSocket listener for server using config.
+func NewWebSocketServer(server *Server, config WebSocketConfig) *WebSocketServer {
+	return &WebSocketServer{server: server, config: config}
+}
+
+func (wss *WebSocketServer) originAllowed(origin string) bool {
+	if len(wss.config.AllowedOrigins) == 0 {
+		return true
+	}
+	for _, allowed := range wss.config.AllowedOrigins {
+		if allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// ListenAndServeTLS starts the WebSocket listener and blocks serving
+// connections until an error occurs.
+func (wss *WebSocketServer) ListenAndServeTLS() os.Error {
+	mux := http.NewServeMux()
+	mux.Handle("/", websocket.Handler(wss.handleConn))
+
+	log.Printf("WebSocketServer listening on %v", wss.config.ListenAddr)
+	return http.ListenAndServeTLS(wss.config.ListenAddr, wss.config.CertFile, wss.config.KeyFile, mux)
+}
+
+// handleConn speaks the framed Mumble protocol over a single WebSocket
+// connection until it is closed, feeding every decoded Message into
+// the same dispatch used by native TCP clients.
+func (wss *WebSocketServer) handleConn(ws *websocket.Conn) {
+	req := ws.Request()
+	if !wss.originAllowed(req.Header.Get("Origin")) {
+		ws.Close()
+		return
+	}
+	ws.PayloadType = websocket.BinaryFrame
+
+	client := wss.server.newClient(&wsFrameConn{Conn: ws})
+	defer wss.server.DisconnectClient(client)
+
+	header := make([]byte, 6)
+	for {
+		if _, err := readFull(ws, header); err != nil {
+			return
+		}
+
+		kind := binary.BigEndian.Uint16(header[0:2])
+		length := binary.BigEndian.Uint32(header[2:6])
+
+		payload := make([]byte, length)
+		if _, err := readFull(ws, payload); err != nil {
+			return
+		}
+
+		wss.server.dispatch(client, &Message{kind: kind, buf: payload, client: client})
+	}
+}
+
+// readFull reads exactly len(buf) bytes from r, the same framing
+// guarantee the TCP listener relies on for its header+payload reads.
+func readFull(r *websocket.Conn, buf []byte) (int, os.Error) {
+	total := 0
+	for total < len(buf) {
+		n, err := r.Read(buf[total:])
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// writeFrame writes a single message as one WebSocket frame containing
+// the 2-byte kind + 4-byte length header the TCP listener uses followed
+// by payload. Browsers only resync their framing on whole WS frames, so
+// this must go out as exactly one Write to ws; see wsFrameConn, which
+// is what actually calls this.
+func writeFrame(ws *websocket.Conn, kind uint16, payload []byte) os.Error {
+	header := make([]byte, 6)
+	binary.BigEndian.PutUint16(header[0:2], kind)
+	binary.BigEndian.PutUint32(header[2:6], uint32(len(payload)))
+
+	buf := bytes.NewBuffer(header)
+	buf.Write(payload)
+	_, err := ws.Write(buf.Bytes())
+	return err
+}
+
+// wsFrameConn is handed to server.newClient in place of the raw
+// *websocket.Conn. Client's send path (shared with the TCP listener)
+// writes a message as the same two pieces the TCP wire format uses -
+// the 6-byte header, then the payload - via separate Write calls. Over
+// a TCP stream those concatenate for free; over a WebSocket connection
+// each Write is its own frame, so passing ws directly would split every
+// outgoing message into two frames the browser could never reassemble.
+// wsFrameConn buffers across Write calls and relays each complete
+// message through writeFrame as a single frame once it has a whole one.
+type wsFrameConn struct {
+	*websocket.Conn
+	pending []byte
+}
+
+func (c *wsFrameConn) Write(p []byte) (int, os.Error) {
+	c.pending = append(c.pending, p...)
+	for len(c.pending) >= 6 {
+		length := binary.BigEndian.Uint32(c.pending[2:6])
+		if uint32(len(c.pending)) < 6+length {
+			break
+		}
+		kind := binary.BigEndian.Uint16(c.pending[0:2])
+		if err := writeFrame(c.Conn, kind, c.pending[6:6+length]); err != nil {
+			return len(p), err
+		}
+		c.pending = c.pending[6+length:]
+	}
+	return len(p), nil
+}